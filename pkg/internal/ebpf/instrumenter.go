@@ -4,9 +4,11 @@ package ebpf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"os"
 	"syscall"
 	"unsafe"
@@ -21,6 +23,37 @@ import (
 	"github.com/grafana/beyla/pkg/internal/goexec"
 )
 
+// AllInterfaces is a sentinel interface name that, when used as a key in the map
+// returned by Tracer.XDPPrograms, makes the instrumenter attach the program to
+// every non-loopback network interface available on the host.
+const AllInterfaces = "*"
+
+// XDPAttachMode selects the XDP attach path the kernel should use, mirroring the
+// modes exposed by the libbpfgo XDP attach wrapper.
+type XDPAttachMode int
+
+const (
+	// XDPAttachModeNative attaches the program directly in the NIC driver. Requires
+	// driver support but gives the best performance.
+	XDPAttachModeNative XDPAttachMode = iota
+	// XDPAttachModeGeneric attaches the program in the kernel network stack, for
+	// drivers that don't support native XDP. Slower, works everywhere.
+	XDPAttachModeGeneric
+	// XDPAttachModeOffloaded offloads the program to a SmartNIC.
+	XDPAttachModeOffloaded
+)
+
+func (m XDPAttachMode) linkFlags() link.XDPAttachFlags {
+	switch m {
+	case XDPAttachModeGeneric:
+		return link.XDPGenericMode
+	case XDPAttachModeOffloaded:
+		return link.XDPOffloadMode
+	default:
+		return link.XDPDriverMode
+	}
+}
+
 type instrumenter struct {
 	offsets   *goexec.Offsets
 	exe       *link.Executable
@@ -85,10 +118,18 @@ func (i *instrumenter) goprobe(probe ebpfcommon.Probe) error {
 
 func (i *instrumenter) kprobes(p KprobesTracer) error {
 	log := ilog().With("probes", "kprobes")
+	kretOpts := p.KretprobeOptions()
+
+	// Shared across every function in this attach pass, so a kernel that needs
+	// the /proc/kallsyms fallback for several functions only pays for reading
+	// and parsing it once.
+	session := newKallsymsSession()
+	defer session.close()
+
 	for kfunc, kprobes := range p.KProbes() {
 		log.Debug("going to add kprobe to function", "function", kfunc, "probes", kprobes)
 
-		if err := i.kprobe(kfunc, kprobes); err != nil {
+		if err := i.kprobe(p, kfunc, kprobes, kretOpts[kfunc], session); err != nil {
 			return fmt.Errorf("instrumenting function %q: %w", kfunc, err)
 		}
 		p.AddCloser(i.closables...)
@@ -97,28 +138,109 @@ func (i *instrumenter) kprobes(p KprobesTracer) error {
 	return nil
 }
 
-func (i *instrumenter) kprobe(funcName string, programs ebpfcommon.FunctionPrograms) error {
+func (i *instrumenter) kprobe(p KprobesTracer, funcName string, programs ebpfcommon.FunctionPrograms, kretOpts KretprobeOptions, session *kallsymsSession) error {
 	if programs.Start != nil {
-		kp, err := link.Kprobe(funcName, programs.Start, nil)
+		kps, err := attachKprobeWithVariants(funcName, session, func(symbol string) (link.Link, error) {
+			return link.Kprobe(symbol, programs.Start, nil)
+		})
 		if err != nil {
 			return fmt.Errorf("setting kprobe: %w", err)
 		}
-		i.closables = append(i.closables, kp)
+		i.closables = append(i.closables, kps...)
 	}
 
 	if programs.End != nil {
-		// The commented code doesn't work on certain kernels. We need to invesigate more to see if it's possible
-		// to productize it. Failure says: "neither debugfs nor tracefs are mounted".
-		kp, err := link.Kretprobe(funcName, programs.End, nil /*&link.KprobeOptions{RetprobeMaxActive: 1024}*/)
+		opts, err := kretprobeAttachOptions(funcName, kretOpts)
+		var maxActiveErr *ErrKretprobeMaxActiveUnsupported
+		if err != nil {
+			if !errors.As(err, &maxActiveErr) {
+				return fmt.Errorf("setting kretprobe: %w", err)
+			}
+			// ErrKretprobeMaxActiveUnsupported is non-fatal: kretprobeAttachOptions
+			// already logged a warning, and opts falls back to the kernel's
+			// default maxactive. Attach the kretprobe anyway instead of aborting
+			// this function (and every other function still left in the attach
+			// pass), but let the tracer know so it can act on the degradation.
+			p.KretprobeDegraded(funcName, maxActiveErr)
+		}
+
+		kps, err := attachKprobeWithVariants(funcName, session, func(symbol string) (link.Link, error) {
+			return link.Kretprobe(symbol, programs.End, opts)
+		})
 		if err != nil {
 			return fmt.Errorf("setting kretprobe: %w", err)
 		}
-		i.closables = append(i.closables, kp)
+		i.closables = append(i.closables, kps...)
 	}
 
 	return nil
 }
 
+// kretprobeAttachOptions translates the caller's requested KretprobeOptions
+// into the link.KprobeOptions to attach with, honoring MaxActive only where
+// the kernel actually supports it. If the kernel can't and the caller asked
+// for a non-default MaxActive, it returns nil opts (the kernel's default
+// maxactive) alongside an ErrKretprobeMaxActiveUnsupported so the
+// caller can log/act on the degradation without having to fail the whole
+// kretprobe attachment.
+func kretprobeAttachOptions(funcName string, kretOpts KretprobeOptions) (*link.KprobeOptions, error) {
+	if kretOpts.MaxActive == 0 {
+		return nil, nil
+	}
+
+	if kernelSupportsPerfKretprobeMaxActive() {
+		return &link.KprobeOptions{RetprobeMaxActive: kretOpts.MaxActive}, nil
+	}
+
+	ilog().Warn("kernel only supports the legacy tracefs kretprobe attach path, which ignores a custom maxactive",
+		"function", funcName, "requested_max_active", kretOpts.MaxActive)
+	return nil, &ErrKretprobeMaxActiveUnsupported{Function: funcName, MaxActive: kretOpts.MaxActive}
+}
+
+// attachKprobeWithVariants attaches a (ret)kprobe to funcName using attach, and
+// transparently falls back to every compiler-split variant of funcName present
+// in /proc/kallsyms (e.g. "tcp_sendmsg.part.0") when the plain name can't be
+// found, which happens for many hot kernel functions on modern kernels.
+func attachKprobeWithVariants(funcName string, session *kallsymsSession, attach func(symbol string) (link.Link, error)) ([]io.Closer, error) {
+	kp, err := attach(funcName)
+	if err == nil {
+		return []io.Closer{kp}, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	variants, resolveErr := session.resolveOptimizedSymbols(funcName)
+	if resolveErr != nil {
+		return nil, fmt.Errorf("%w (and resolving optimized variants failed: %s)", err, resolveErr)
+	}
+	if len(variants) == 0 {
+		return nil, err
+	}
+
+	ilog().Debug("function not found verbatim in /proc/kallsyms, attaching to its optimized variants instead",
+		"function", funcName, "variants", variants)
+
+	links := make([]io.Closer, 0, len(variants))
+	for _, variant := range variants {
+		kp, err := attach(variant)
+		if err != nil {
+			for _, l := range links {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("attaching to variant %q: %w", variant, err)
+		}
+		links = append(links, kp)
+	}
+
+	return links, nil
+}
+
+// uprobes attaches process-wide uprobes for the given pid's shared libraries.
+// For tracers that need probes scoped to a single PID's lifetime (so they
+// don't leak onto every other process mapping the same library), see the
+// Attacher in package github.com/grafana/beyla/pkg/internal/ebpf/uprobes.
+//
 //nolint:cyclop
 func (i *instrumenter) uprobes(pid int32, p Tracer) error {
 	maps, err := processMaps(pid)
@@ -207,6 +329,135 @@ func (i *instrumenter) uprobe(funcName string, exe *link.Executable, probe ebpfc
 	return nil
 }
 
+func (i *instrumenter) xdps(p Tracer) error {
+	log := ilog().With("probes", "xdps")
+	flags := p.XDPAttachMode().linkFlags()
+
+	for ifaceName, prog := range p.XDPPrograms() {
+		ifaces, err := xdpInterfaces(ifaceName)
+		if err != nil {
+			return fmt.Errorf("resolving interfaces for XDP attachment %q: %w", ifaceName, err)
+		}
+		// In AllInterfaces mode, a single interface that doesn't support this
+		// attach mode (e.g. a veth or a driver without native XDP) shouldn't
+		// stop us from instrumenting every other interface on the host.
+		allInterfaces := ifaceName == AllInterfaces
+
+		for _, iface := range ifaces {
+			lnk, err := link.AttachXDP(link.XDPOptions{
+				Program:   prog,
+				Interface: iface.Index,
+				Flags:     flags,
+			})
+			if err != nil {
+				if allInterfaces {
+					log.Warn("couldn't attach XDP program to interface, skipping it", "interface", iface.Name, "error", err)
+					continue
+				}
+				return fmt.Errorf("attaching XDP program to interface %q: %w", iface.Name, err)
+			}
+			log.Debug("attached XDP program", "interface", iface.Name)
+			i.closables = append(i.closables, lnk)
+		}
+		p.AddCloser(i.closables...)
+	}
+
+	return nil
+}
+
+// xdpInterfaces resolves an interface name as used in a Tracer's XDPPrograms map
+// into the concrete network interfaces an XDP program should be attached to. The
+// AllInterfaces sentinel expands to every non-loopback interface on the host.
+func xdpInterfaces(ifaceName string) ([]net.Interface, error) {
+	if ifaceName != AllInterfaces {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Interface{*iface}, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []net.Interface
+	for _, iface := range all {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+//nolint:cyclop
+func (i *instrumenter) usdtprobes(pid int32, p Tracer) error {
+	log := ilog().With("probes", "usdtprobes")
+	notes, err := parseStapsdtNotes(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return fmt.Errorf("parsing USDT probes: %w", err)
+	}
+	supportsRefCtr := kernelSupportsRefCtrOffset()
+
+	for provider, probes := range p.USDTProbes() {
+		for probeName, funcPrograms := range probes {
+			note, ok := findUSDTNote(notes, provider, probeName)
+			if !ok {
+				log.Debug("USDT probe not found in executable", "provider", provider, "probe", probeName)
+				continue
+			}
+			log.Debug("going to instrument USDT probe", "provider", provider, "probe", probeName,
+				"location", note.Location, "semaphore", note.SemaphoreAddr, "ref_ctr_offset", supportsRefCtr)
+			if err := i.usdtprobe(pid, note, funcPrograms, supportsRefCtr); err != nil {
+				return fmt.Errorf("instrumenting USDT probe %s:%s: %w", provider, probeName, err)
+			}
+			p.AddCloser(i.closables...)
+		}
+	}
+
+	return nil
+}
+
+func findUSDTNote(notes []USDTNote, provider, name string) (USDTNote, bool) {
+	for _, n := range notes {
+		if n.Provider == provider && n.Name == name {
+			return n, true
+		}
+	}
+	return USDTNote{}, false
+}
+
+func (i *instrumenter) usdtprobe(pid int32, note USDTNote, programs ebpfcommon.FunctionPrograms, supportsRefCtr bool) error {
+	opts := &link.UprobeOptions{Address: note.Location}
+	if supportsRefCtr && note.SemaphoreAddr != 0 {
+		opts.RefCtrOffset = note.SemaphoreAddr
+	}
+
+	attached := false
+	if programs.Start != nil {
+		up, err := i.exe.Uprobe("", programs.Start, opts)
+		if err != nil {
+			return fmt.Errorf("setting USDT uprobe: %w", err)
+		}
+		i.closables = append(i.closables, up)
+		attached = true
+	}
+
+	if !attached || note.SemaphoreAddr == 0 || supportsRefCtr {
+		return nil
+	}
+
+	// The kernel can't increment the semaphore for us: do it by hand and make
+	// sure it gets decremented again when the probe is detached.
+	if err := incrementSemaphore(pid, note.SemaphoreAddr); err != nil {
+		return fmt.Errorf("incrementing USDT semaphore: %w", err)
+	}
+	i.closables = append(i.closables, &usdtSemaphore{pid: pid, addr: note.SemaphoreAddr})
+
+	return nil
+}
+
 func (i *instrumenter) sockfilters(p Tracer) error {
 	for _, filter := range p.SocketFilters() {
 		fd, err := attachSocketFilter(filter)
@@ -0,0 +1,146 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// kallsymsVariantSuffixes matches the compiler-split variants GCC produces for
+// hot kernel functions, e.g. "tcp_sendmsg.part.0", "inet_recvmsg.isra.0",
+// "wake_up.constprop.0" or "foo.cold".
+const kallsymsVariantSuffixes = `isra|part|constprop|cold`
+
+var kallsymsCache kallsymsSymbols
+
+// kallsymsSymbols is a refcounted, cached view of the symbol names in
+// /proc/kallsyms. Parsing the file is comparatively expensive and several
+// kprobes may need to resolve optimized variants during the same attach pass,
+// so we read it once and share it for as long as somebody's using it.
+type kallsymsSymbols struct {
+	mu    sync.Mutex
+	refs  int
+	names []string
+	err   error
+}
+
+func (k *kallsymsSymbols) acquire() ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.refs == 0 {
+		k.names, k.err = readKallsymsNames()
+	}
+	k.refs++
+	return k.names, k.err
+}
+
+func (k *kallsymsSymbols) release() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.refs == 0 {
+		return
+	}
+	k.refs--
+	if k.refs == 0 {
+		k.names = nil
+		k.err = nil
+	}
+}
+
+func readKallsymsNames() ([]string, error) {
+	f, err := os.Open("/proc/kallsyms")
+	if err != nil {
+		return nil, fmt.Errorf("opening /proc/kallsyms: %w", err)
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		names = append(names, fields[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading /proc/kallsyms: %w", err)
+	}
+
+	return names, nil
+}
+
+// kallsymsSession shares a single kallsymsCache reference across every
+// resolveOptimizedSymbols call made during one attach pass (e.g. one
+// instrumenter.kprobes call instrumenting many functions), instead of each
+// call acquiring and releasing the cache on its own and dropping it back to
+// zero refs - and therefore re-reading and re-parsing /proc/kallsyms from
+// scratch - in between.
+type kallsymsSession struct {
+	mu     sync.Mutex
+	names  []string
+	err    error
+	loaded bool
+}
+
+func newKallsymsSession() *kallsymsSession {
+	return &kallsymsSession{}
+}
+
+// resolveOptimizedSymbols returns every symbol in /proc/kallsyms matching
+// funcName itself, or one of the compiler-generated variants the kernel's hot
+// functions get split into. On success the caller ends up attaching a kprobe
+// to every variant that's actually present in this kernel build.
+func (s *kallsymsSession) resolveOptimizedSymbols(funcName string) ([]string, error) {
+	s.mu.Lock()
+	if !s.loaded {
+		s.names, s.err = kallsymsCache.acquire()
+		s.loaded = true
+	}
+	names, err := s.names, s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return matchKallsymsVariants(names, funcName)
+}
+
+// matchKallsymsVariants returns every entry in names matching funcName
+// itself, or one of the compiler-generated variants the kernel's hot
+// functions get split into.
+func matchKallsymsVariants(names []string, funcName string) ([]string, error) {
+	pattern, err := regexp.Compile(fmt.Sprintf(`^%s(\.(%s)(\.[0-9]+)?)?$`, regexp.QuoteMeta(funcName), kallsymsVariantSuffixes))
+	if err != nil {
+		return nil, fmt.Errorf("compiling kallsyms variant pattern for %q: %w", funcName, err)
+	}
+
+	var matches []string
+	for _, n := range names {
+		if pattern.MatchString(n) {
+			matches = append(matches, n)
+		}
+	}
+
+	return matches, nil
+}
+
+// close releases this session's reference on the shared kallsyms cache, if it
+// ever acquired one. Callers should defer it once per attach pass.
+func (s *kallsymsSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.loaded {
+		kallsymsCache.release()
+		s.loaded = false
+	}
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchKallsymsVariants(t *testing.T) {
+	names := []string{
+		"tcp_sendmsg",
+		"tcp_sendmsg.isra.0",
+		"tcp_sendmsg.cold",
+		"tcp_sendmsg_locked",
+		"inet_recvmsg.part.3",
+		"wake_up.constprop.0",
+		"unrelated_func",
+	}
+
+	tests := []struct {
+		name     string
+		funcName string
+		want     []string
+	}{
+		{
+			name:     "matches the plain name and its variants, not lookalikes",
+			funcName: "tcp_sendmsg",
+			want:     []string{"tcp_sendmsg", "tcp_sendmsg.isra.0", "tcp_sendmsg.cold"},
+		},
+		{
+			name:     "matches a part variant",
+			funcName: "inet_recvmsg",
+			want:     []string{"inet_recvmsg.part.3"},
+		},
+		{
+			name:     "matches a constprop variant",
+			funcName: "wake_up",
+			want:     []string{"wake_up.constprop.0"},
+		},
+		{
+			name:     "no match returns an empty slice",
+			funcName: "does_not_exist",
+			want:     nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchKallsymsVariants(names, tt.funcName)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchKallsymsVariantsQuotesFuncName(t *testing.T) {
+	names := []string{"foo.bar", "foobar"}
+	got, err := matchKallsymsVariants(names, "foo.bar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"foo.bar"}) {
+		t.Fatalf("expected the literal dot to not act as a wildcard, got %v", got)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// kprobePMUPath is present on kernels (4.17+) that expose kprobes through the
+// perf event subsystem. Only that attach path honors a custom kretprobe
+// maxactive; the legacy kprobe_events interface under debugfs/tracefs always
+// uses the kernel's built-in default.
+const kprobePMUPath = "/sys/bus/event_source/devices/kprobe"
+
+var perfKretprobeMaxActiveSupport = sync.OnceValue(func() bool {
+	_, err := os.Stat(kprobePMUPath)
+	return err == nil
+})
+
+// kernelSupportsPerfKretprobeMaxActive reports whether the running kernel can
+// attach a kretprobe through the perf-event path, which is the only one that
+// accepts a caller-specified MaxActive.
+func kernelSupportsPerfKretprobeMaxActive() bool {
+	return perfKretprobeMaxActiveSupport()
+}
+
+// KretprobeOptions configures how a kretprobe for a particular kernel function
+// is attached. It's returned, per function name, by a KprobesTracer that wants
+// non-default behaviour - see KprobesTracer.KretprobeOptions.
+type KretprobeOptions struct {
+	// MaxActive bounds the number of instances of the probed function that can
+	// be in flight at once, i.e. how many concurrent return addresses the
+	// kernel tracks. The kernel's own default (a small multiple of NCPU) is
+	// too low for hot functions like tcp_sendmsg under load, which silently
+	// drops return events once it's exceeded. Only honored when the kernel
+	// supports attaching kretprobes via the perf-event path; see
+	// kernelSupportsPerfKretprobeMaxActive.
+	MaxActive int
+}
+
+// ErrKretprobeMaxActiveUnsupported is returned when a tracer requests a
+// kretprobe MaxActive but the running kernel only exposes the legacy
+// kprobe_events (debugfs/tracefs) attach path, which can't honor it. Tracers
+// that care can act on it, e.g. by falling back to an entry-probe-only
+// emulation of the return path.
+type ErrKretprobeMaxActiveUnsupported struct {
+	Function  string
+	MaxActive int
+}
+
+func (e *ErrKretprobeMaxActiveUnsupported) Error() string {
+	return fmt.Sprintf("kernel doesn't support a custom kretprobe maxactive (requested %d for function %q): "+
+		"only the perf-event kprobe PMU supports this, and %s is absent", e.MaxActive, e.Function, kprobePMUPath)
+}
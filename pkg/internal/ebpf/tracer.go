@@ -0,0 +1,52 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"io"
+
+	"github.com/cilium/ebpf"
+
+	ebpfcommon "github.com/grafana/beyla/pkg/internal/ebpf/common"
+)
+
+// Tracer is implemented by the tracer types of every auto-instrumented executable
+// (e.g. Go applications, generic executables relying on shared libraries...).
+// The instrumenter uses it to find out which probes it has to attach.
+type Tracer interface {
+	AddCloser(closer ...io.Closer)
+	GoProbes() map[string]ebpfcommon.FunctionPrograms
+	KProbes() map[string]ebpfcommon.FunctionPrograms
+	UProbes() map[string]map[string]ebpfcommon.FunctionPrograms
+	// USDTProbes returns the programs to attach to USDT (User Statically-Defined
+	// Tracing) probe sites, keyed by provider name and then by probe name.
+	USDTProbes() map[string]map[string]ebpfcommon.FunctionPrograms
+	SocketFilters() []*ebpf.Program
+	// XDPPrograms returns the XDP programs that the instrumenter must attach, keyed by
+	// the network interface name they should be attached to. Use AllInterfaces to
+	// attach a program to every non-loopback interface present on the host.
+	XDPPrograms() map[string]*ebpf.Program
+	// XDPAttachMode selects the XDP attach path (native/generic/offloaded) used
+	// for every program returned by XDPPrograms.
+	XDPAttachMode() XDPAttachMode
+	AlreadyInstrumentedLib(ino uint64) bool
+	RecordInstrumentedLib(ino uint64)
+}
+
+// KprobesTracer is implemented by tracers that only need to hook into kernel
+// functions and don't require any of the other Tracer capabilities.
+type KprobesTracer interface {
+	AddCloser(closer ...io.Closer)
+	KProbes() map[string]ebpfcommon.FunctionPrograms
+	// KretprobeOptions returns per-function kretprobe attach options, keyed by
+	// the same function name used in KProbes. A function with no entry in the
+	// returned map gets the kernel's default behaviour.
+	KretprobeOptions() map[string]KretprobeOptions
+	// KretprobeDegraded is called when a function's requested MaxActive
+	// couldn't be honored because the kernel only supports the legacy
+	// tracefs kretprobe attach path. The instrumenter still attaches the
+	// kretprobe with the kernel's default maxactive; a tracer that cares
+	// about the resulting return-event drops under load can act on it here,
+	// e.g. by surfacing a metric or switching to degraded behaviour.
+	KretprobeDegraded(funcName string, err *ErrKretprobeMaxActiveUnsupported)
+}
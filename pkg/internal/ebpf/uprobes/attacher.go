@@ -0,0 +1,256 @@
+//go:build linux
+
+// Package uprobes implements a central uprobe attachment subsystem that scopes
+// probes to the lifetime of the process that needs them, instead of the
+// process-wide attachment done by the per-tracer uprobes loop in package ebpf.
+package uprobes
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf/link"
+
+	ebpfcommon "github.com/grafana/beyla/pkg/internal/ebpf/common"
+	"github.com/grafana/beyla/pkg/internal/exec"
+)
+
+func alog() *slog.Logger {
+	return slog.With("component", "ebpf.uprobes.Attacher")
+}
+
+// Rule describes a library (or executable) to instrument and the uprobes to
+// attach to it. A library is matched by LibRegex, by BuildID, or both; at
+// least one of the two must be set for the rule to ever match anything.
+type Rule struct {
+	LibRegex *regexp.Regexp
+	BuildID  string
+	Symbols  map[string]ebpfcommon.FunctionPrograms
+	// Required makes the first attachment failure under this rule abort the
+	// rule for that library: the links it already set are closed and the
+	// failure is logged as an error. Other rules, and other libraries of the
+	// same process, are still attached. Without Required, a failing symbol is
+	// skipped and logged at debug level.
+	Required bool
+}
+
+func (r *Rule) matches(libPath, instrPath string) bool {
+	if r.LibRegex != nil && r.LibRegex.MatchString(libPath) {
+		return true
+	}
+	if r.BuildID != "" {
+		if id, err := buildID(instrPath); err == nil && id == r.BuildID {
+			return true
+		}
+	}
+	return false
+}
+
+// ProcessEventType distinguishes process lifecycle events delivered to an
+// Attacher.
+type ProcessEventType int
+
+const (
+	ProcessStart ProcessEventType = iota
+	ProcessExit
+)
+
+// ProcessEvent is a process start/exit notification, as produced by Beyla's
+// process discovery pipeline.
+type ProcessEvent struct {
+	Type ProcessEventType
+	PID  int32
+}
+
+// Attacher attaches uprobes scoped to the PID of the process that needs them
+// (via link.UprobeOptions.PID) and tears them all down again when that
+// process exits. It mirrors the design used by DataDog's USM uprobe attacher
+// and Skywalking's linker, which tracks a set of already-instrumented
+// libraries to avoid double-attaching in container mode.
+type Attacher struct {
+	rules []Rule
+
+	mu sync.Mutex
+	// openExecs caches the link.Executable opened for each library inode
+	// we've already resolved, so that a later PID mapping the same file
+	// reuses it instead of opening it again.
+	openExecs map[uint64]*link.Executable
+	// pidLinks tracks every link opened on behalf of a given PID, so they can
+	// all be closed in one go when that process exits.
+	pidLinks map[int32][]io.Closer
+}
+
+// NewAttacher creates an Attacher that instruments new processes according to
+// rules.
+func NewAttacher(rules []Rule) *Attacher {
+	return &Attacher{
+		rules:     rules,
+		openExecs: map[uint64]*link.Executable{},
+		pidLinks:  map[int32][]io.Closer{},
+	}
+}
+
+// Run consumes process lifecycle events until events is closed, attaching and
+// detaching uprobes as processes come and go. It's meant to be run in its own
+// goroutine, fed by Beyla's process discovery pipeline.
+func (a *Attacher) Run(events <-chan ProcessEvent) {
+	for ev := range events {
+		switch ev.Type {
+		case ProcessStart:
+			if err := a.onProcessStart(ev.PID); err != nil {
+				alog().Debug("not instrumenting process", "pid", ev.PID, "error", err)
+			}
+		case ProcessExit:
+			a.onProcessExit(ev.PID)
+		}
+	}
+}
+
+func (a *Attacher) onProcessStart(pid int32) error {
+	maps, err := exec.FindLibMaps(pid)
+	if err != nil {
+		return fmt.Errorf("reading maps of process %d: %w", pid, err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, m := range maps {
+		if m.Pathname == "" {
+			continue
+		}
+		if _, ok := seen[m.Pathname]; ok {
+			continue
+		}
+		seen[m.Pathname] = struct{}{}
+
+		instrPath := fmt.Sprintf("/proc/%d/map_files/%x-%x", pid, m.StartAddr, m.EndAddr)
+		a.tryAttach(pid, m.Pathname, instrPath)
+	}
+
+	// Some libraries, e.g. OpenSSL inside a statically-linked NodeJS binary,
+	// aren't mapped as a separate shared object: fall back to matching rules
+	// against the executable itself.
+	exePath := fmt.Sprintf("/proc/%d/exe", pid)
+	a.tryAttach(pid, exePath, exePath)
+
+	return nil
+}
+
+func (a *Attacher) tryAttach(pid int32, libPath, instrPath string) {
+	for idx := range a.rules {
+		rule := &a.rules[idx]
+		if !rule.matches(libPath, instrPath) {
+			continue
+		}
+
+		links, err := a.attachToLib(pid, instrPath, rule)
+		if err != nil {
+			if rule.Required {
+				alog().Error("failed required uprobe attachment", "pid", pid, "lib", libPath, "error", err)
+			} else {
+				alog().Debug("error attaching uprobes", "pid", pid, "lib", libPath, "error", err)
+			}
+			continue
+		}
+
+		a.mu.Lock()
+		a.pidLinks[pid] = append(a.pidLinks[pid], links...)
+		a.mu.Unlock()
+	}
+}
+
+func (a *Attacher) attachToLib(pid int32, instrPath string, rule *Rule) ([]io.Closer, error) {
+	info, err := os.Stat(instrPath)
+	if err != nil {
+		return nil, fmt.Errorf("stat %q: %w", instrPath, err)
+	}
+	ino := inode(info)
+
+	exe, firstOpen, err := a.openExecutable(ino, instrPath)
+	if err != nil {
+		return nil, err
+	}
+	if firstOpen {
+		alog().Debug("instrumented library for pid", "path", instrPath, "inode", ino, "pid", pid)
+	}
+
+	var links []io.Closer
+	for symbol, progs := range rule.Symbols {
+		if progs.Start != nil {
+			up, err := exe.Uprobe(symbol, progs.Start, &link.UprobeOptions{PID: int(pid)})
+			if err != nil {
+				if rule.Required {
+					closeAll(links)
+					return nil, fmt.Errorf("setting uprobe on %q: %w", symbol, err)
+				}
+				alog().Debug("error setting uprobe", "pid", pid, "symbol", symbol, "error", err)
+				continue
+			}
+			links = append(links, up)
+		}
+
+		if progs.End != nil {
+			urp, err := exe.Uretprobe(symbol, progs.End, &link.UprobeOptions{PID: int(pid)})
+			if err != nil {
+				if rule.Required {
+					closeAll(links)
+					return nil, fmt.Errorf("setting uretprobe on %q: %w", symbol, err)
+				}
+				alog().Debug("error setting uretprobe", "pid", pid, "symbol", symbol, "error", err)
+				continue
+			}
+			links = append(links, urp)
+		}
+	}
+
+	return links, nil
+}
+
+// openExecutable returns the link.Executable for the library at ino, opening
+// it once with link.OpenExecutable and caching it for every later PID that
+// maps the same file. The returned bool reports whether this call opened it.
+func (a *Attacher) openExecutable(ino uint64, instrPath string) (*link.Executable, bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if exe, ok := a.openExecs[ino]; ok {
+		return exe, false, nil
+	}
+
+	exe, err := link.OpenExecutable(instrPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("opening executable %q: %w", instrPath, err)
+	}
+	a.openExecs[ino] = exe
+	return exe, true, nil
+}
+
+func (a *Attacher) onProcessExit(pid int32) {
+	a.mu.Lock()
+	links := a.pidLinks[pid]
+	delete(a.pidLinks, pid)
+	a.mu.Unlock()
+
+	for _, l := range links {
+		if err := l.Close(); err != nil {
+			alog().Debug("error detaching uprobe", "pid", pid, "error", err)
+		}
+	}
+}
+
+func closeAll(links []io.Closer) {
+	for _, l := range links {
+		_ = l.Close()
+	}
+}
+
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
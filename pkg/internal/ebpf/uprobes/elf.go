@@ -0,0 +1,80 @@
+//go:build linux
+
+package uprobes
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// buildID extracts the ELF GNU build-id (as a lowercase hex string) from the
+// executable at path, letting a Rule match a library regardless of the path
+// it happens to be mapped at.
+func buildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("opening ELF file %q: %w", path, err)
+	}
+	defer f.Close()
+
+	sec := f.Section(".note.gnu.build-id")
+	if sec == nil {
+		return "", fmt.Errorf("no .note.gnu.build-id section in %q", path)
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return "", fmt.Errorf("reading .note.gnu.build-id: %w", err)
+	}
+
+	id, err := parseBuildIDNote(data, f.ByteOrder)
+	if err != nil {
+		return "", fmt.Errorf("%w in %q", err, path)
+	}
+	return id, nil
+}
+
+// parseBuildIDNote decodes a .note.gnu.build-id section's raw bytes into a
+// lowercase hex build-id string. Bounds-check every offset derived from the
+// note before slicing: the instrumented executable isn't under our control,
+// and a malformed note must return an error here instead of panicking on an
+// out-of-range slice.
+func parseBuildIDNote(data []byte, order binary.ByteOrder) (string, error) {
+	if len(data) < 12 {
+		return "", fmt.Errorf("truncated build-id note")
+	}
+
+	nameSz := order.Uint32(data[0:4])
+	descSz := order.Uint32(data[4:8])
+	remaining := uint32(len(data) - 12)
+
+	if nameSz > remaining {
+		return "", fmt.Errorf("malformed build-id note: name size %d exceeds note length", nameSz)
+	}
+	nameEnd := align4(nameSz)
+	if nameEnd > remaining {
+		return "", fmt.Errorf("malformed build-id note: padded name size %d exceeds note length", nameEnd)
+	}
+
+	name := data[12 : 12+nameEnd]
+	if !bytes.HasPrefix(name, []byte("GNU\x00")) {
+		return "", fmt.Errorf("unexpected build-id note owner")
+	}
+
+	descStart := 12 + nameEnd
+	remaining = uint32(len(data)) - descStart
+	if descSz > remaining || align4(descSz) > remaining {
+		return "", fmt.Errorf("malformed build-id note: descriptor size %d exceeds note length", descSz)
+	}
+
+	desc := data[descStart : descStart+descSz]
+
+	return hex.EncodeToString(desc), nil
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package uprobes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func buildIDNote(nameSz, descSz uint32, name, desc []byte) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, nameSz)
+	_ = binary.Write(&buf, binary.LittleEndian, descSz)
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(3)) // NT_GNU_BUILD_ID
+	buf.Write(name)
+	buf.Write(desc)
+	return buf.Bytes()
+}
+
+func TestParseBuildIDNote(t *testing.T) {
+	t.Run("valid note", func(t *testing.T) {
+		desc := []byte{0xde, 0xad, 0xbe, 0xef}
+		data := buildIDNote(4, uint32(len(desc)), []byte("GNU\x00"), desc)
+		id, err := parseBuildIDNote(data, binary.LittleEndian)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := hex.EncodeToString(desc); id != want {
+			t.Errorf("got %q, want %q", id, want)
+		}
+	})
+
+	t.Run("padded name", func(t *testing.T) {
+		// nameSz of 3 ("GNU" without its trailing NUL) still occupies 4
+		// padded bytes before the descriptor starts.
+		desc := []byte{0x01, 0x02}
+		paddedDesc := append(append([]byte{}, desc...), 0x00, 0x00) // padded to align4(2)
+		data := buildIDNote(3, uint32(len(desc)), []byte("GNU\x00"), paddedDesc)
+		id, err := parseBuildIDNote(data, binary.LittleEndian)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if want := hex.EncodeToString(desc); id != want {
+			t.Errorf("got %q, want %q", id, want)
+		}
+	})
+
+	t.Run("too short to hold a header", func(t *testing.T) {
+		if _, err := parseBuildIDNote([]byte{1, 2, 3}, binary.LittleEndian); err == nil {
+			t.Fatal("expected an error for a truncated note")
+		}
+	})
+
+	t.Run("name size overruns the note", func(t *testing.T) {
+		data := buildIDNote(1000, 4, []byte("GNU\x00"), []byte{0, 0, 0, 0})
+		if _, err := parseBuildIDNote(data, binary.LittleEndian); err == nil {
+			t.Fatal("expected an error for an oversized name field")
+		}
+	})
+
+	t.Run("descriptor size overruns the note", func(t *testing.T) {
+		data := buildIDNote(4, 1000, []byte("GNU\x00"), []byte{0, 0, 0, 0})
+		if _, err := parseBuildIDNote(data, binary.LittleEndian); err == nil {
+			t.Fatal("expected an error for an oversized descriptor field")
+		}
+	})
+
+	t.Run("unexpected note owner", func(t *testing.T) {
+		desc := []byte{0x01}
+		data := buildIDNote(4, uint32(len(desc)), []byte("FOO\x00"), desc)
+		if _, err := parseBuildIDNote(data, binary.LittleEndian); err == nil {
+			t.Fatal("expected an error for a non-GNU note owner")
+		}
+	})
+}
@@ -0,0 +1,258 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// refCtrOffsetFeaturePath is present when the running kernel supports passing
+// link.UprobeOptions.RefCtrOffset, i.e. it can increment a USDT semaphore itself
+// instead of requiring userspace to poke the target process' memory.
+const refCtrOffsetFeaturePath = "/sys/bus/event_source/devices/uprobe/format/ref_ctr_offset"
+
+var refCtrOffsetSupport = sync.OnceValue(func() bool {
+	_, err := os.Stat(refCtrOffsetFeaturePath)
+	return err == nil
+})
+
+// kernelSupportsRefCtrOffset reports whether the running kernel (4.20+) can
+// manage a USDT semaphore on our behalf via link.UprobeOptions.RefCtrOffset.
+func kernelSupportsRefCtrOffset() bool {
+	return refCtrOffsetSupport()
+}
+
+// USDTArgument is a single typed argument descriptor extracted from a USDT
+// probe's argument format string, as documented by systemtap's sys/sdt.h.
+type USDTArgument struct {
+	// Size is the argument size in bytes; negative means the argument is signed.
+	Size int
+	// Op locates the argument in pt_regs: either a bare register ("%eax") or a
+	// memory reference ("-4(%rbp)").
+	Op string
+}
+
+// USDTNote describes a single USDT (User Statically-Defined Tracing) probe site
+// parsed out of an ELF binary's .note.stapsdt section.
+type USDTNote struct {
+	Provider      string
+	Name          string
+	Location      uint64
+	BaseAddr      uint64
+	SemaphoreAddr uint64
+	rawArgs       string
+}
+
+// Arguments parses the note's raw argument format string (e.g.
+// "4@%eax -2@-4(%rbp)") into typed descriptors so a BPF program can pull the
+// USDT probe's arguments out of pt_regs.
+func (n USDTNote) Arguments() ([]USDTArgument, error) {
+	if n.rawArgs == "" {
+		return nil, nil
+	}
+	fields := strings.Fields(n.rawArgs)
+	args := make([]USDTArgument, 0, len(fields))
+	for _, f := range fields {
+		parts := strings.SplitN(f, "@", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid USDT argument descriptor %q", f)
+		}
+		size, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid USDT argument size %q: %w", parts[0], err)
+		}
+		args = append(args, USDTArgument{Size: size, Op: parts[1]})
+	}
+	return args, nil
+}
+
+// parseStapsdtNotes reads the .note.stapsdt section of the ELF file at path and
+// returns every USDT probe site it describes. A missing section is not an
+// error: it just means the binary has no USDT probes.
+func parseStapsdtNotes(path string) ([]USDTNote, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening ELF file %q: %w", path, err)
+	}
+	defer f.Close()
+
+	sec := f.Section(".note.stapsdt")
+	if sec == nil {
+		return nil, nil
+	}
+
+	data, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading .note.stapsdt: %w", err)
+	}
+
+	addrSize := 4
+	if f.Class == elf.ELFCLASS64 {
+		addrSize = 8
+	}
+
+	// The probe location recorded in each note is only valid relative to the
+	// .stapsdt.base section's address *as it was when the note was written*.
+	// Prelinking/rebasing tools can move that section without updating the
+	// notes, so we resolve its current address and correct for the drift
+	// below (location - note's base + this section's actual address).
+	var stapsdtBaseAddr uint64
+	if base := f.Section(".stapsdt.base"); base != nil {
+		stapsdtBaseAddr = base.Addr
+	}
+
+	return decodeStapsdtNotes(data, f.ByteOrder, addrSize, stapsdtBaseAddr)
+}
+
+func decodeStapsdtNotes(data []byte, order binary.ByteOrder, addrSize int, stapsdtBaseAddr uint64) ([]USDTNote, error) {
+	var notes []USDTNote
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var nameSz, descSz, noteType uint32
+		if err := binary.Read(r, order, &nameSz); err != nil {
+			break
+		}
+		if err := binary.Read(r, order, &descSz); err != nil {
+			return notes, err
+		}
+		if err := binary.Read(r, order, &noteType); err != nil {
+			return notes, err
+		}
+
+		name, err := readNotePadded(r, nameSz)
+		if err != nil {
+			return notes, fmt.Errorf("reading stapsdt note name: %w", err)
+		}
+		desc, err := readNotePadded(r, descSz)
+		if err != nil {
+			return notes, fmt.Errorf("reading stapsdt note descriptor: %w", err)
+		}
+
+		// note type 3 is NT_STAPSDT, reserved for "stapsdt" notes by systemtap.
+		if noteType != 3 || !bytes.HasPrefix(name, []byte("stapsdt\x00")) {
+			continue
+		}
+
+		note, err := decodeStapsdtDesc(desc[:descSz], order, addrSize, stapsdtBaseAddr)
+		if err != nil {
+			return notes, fmt.Errorf("decoding stapsdt note: %w", err)
+		}
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+// readNotePadded reads a note's size-prefixed, 4-byte-aligned field from r,
+// rejecting sizes that overrun the note data. The traced binary is untrusted
+// input, so a corrupt or adversarial size field must fail cleanly here rather
+// than driving an out-of-bounds read further down the line.
+func readNotePadded(r *bytes.Reader, size uint32) ([]byte, error) {
+	remaining := uint32(r.Len())
+	if size > remaining {
+		return nil, fmt.Errorf("field size %d exceeds %d remaining bytes", size, remaining)
+	}
+	padded := align4(size)
+	if padded > remaining {
+		return nil, fmt.Errorf("padded field size %d exceeds %d remaining bytes", padded, remaining)
+	}
+
+	buf := make([]byte, padded)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+func decodeStapsdtDesc(desc []byte, order binary.ByteOrder, addrSize int, stapsdtBaseAddr uint64) (USDTNote, error) {
+	if len(desc) < addrSize*3 {
+		return USDTNote{}, fmt.Errorf("truncated stapsdt descriptor")
+	}
+
+	readAddr := func(b []byte) uint64 {
+		if addrSize == 8 {
+			return order.Uint64(b)
+		}
+		return uint64(order.Uint32(b))
+	}
+
+	location := readAddr(desc[0*addrSize : 1*addrSize])
+	base := readAddr(desc[1*addrSize : 2*addrSize])
+	semaphore := readAddr(desc[2*addrSize : 3*addrSize])
+
+	if stapsdtBaseAddr == 0 {
+		// No .stapsdt.base section to correct against: assume the binary
+		// hasn't been rebased and use the location exactly as recorded.
+		stapsdtBaseAddr = base
+	}
+
+	note := USDTNote{
+		Location:      location - base + stapsdtBaseAddr,
+		BaseAddr:      base,
+		SemaphoreAddr: semaphore,
+	}
+
+	fields := bytes.SplitN(desc[3*addrSize:], []byte{0}, 3)
+	if len(fields) < 2 {
+		return USDTNote{}, fmt.Errorf("malformed stapsdt descriptor strings")
+	}
+	note.Provider = string(fields[0])
+	note.Name = string(fields[1])
+	if len(fields) == 3 {
+		note.rawArgs = strings.TrimRight(string(fields[2]), "\x00")
+	}
+
+	return note, nil
+}
+
+// usdtSemaphore decrements a manually-incremented USDT semaphore on Close,
+// undoing what addToSemaphore did when the probe was attached. It is only used
+// on kernels that don't support link.UprobeOptions.RefCtrOffset.
+type usdtSemaphore struct {
+	pid  int32
+	addr uint64
+}
+
+func (s *usdtSemaphore) Close() error {
+	return addToSemaphore(s.pid, s.addr, -1)
+}
+
+// incrementSemaphore manually increments the USDT semaphore counter at addr in
+// the target process, for kernels older than 4.20 where the uprobe uAPI can't
+// do it for us. This is what the kernel does internally when RefCtrOffset is
+// used, reimplemented in userspace via process_vm_writev.
+func incrementSemaphore(pid int32, addr uint64) error {
+	return addToSemaphore(pid, addr, 1)
+}
+
+func addToSemaphore(pid int32, addr uint64, delta int16) error {
+	var current [2]byte
+	local := []unix.Iovec{{Base: &current[0], Len: 2}}
+	remote := []unix.RemoteIovec{{Base: uintptr(addr), Len: 2}}
+
+	if _, err := unix.ProcessVMReadv(int(pid), local, remote, 0); err != nil {
+		return fmt.Errorf("reading USDT semaphore at %#x: %w", addr, err)
+	}
+
+	value := int16(binary.LittleEndian.Uint16(current[:])) + delta
+	binary.LittleEndian.PutUint16(current[:], uint16(value))
+
+	if _, err := unix.ProcessVMWritev(int(pid), local, remote, 0); err != nil {
+		return fmt.Errorf("writing USDT semaphore at %#x: %w", addr, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package ebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadNotePadded(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		size    uint32
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "exact multiple of four",
+			data: []byte("abcd"),
+			size: 4,
+			want: []byte("abcd"),
+		},
+		{
+			name: "padded to four-byte boundary",
+			data: []byte("ab\x00\x00"),
+			size: 2,
+			want: []byte("ab\x00\x00"),
+		},
+		{
+			name:    "size exceeds remaining bytes",
+			data:    []byte("ab"),
+			size:    3,
+			wantErr: true,
+		},
+		{
+			name:    "padded size exceeds remaining bytes",
+			data:    []byte("ab"),
+			size:    2,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readNotePadded(bytes.NewReader(tt.data), tt.size)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStapsdtDesc(t *testing.T) {
+	buildDesc := func(location, base, semaphore uint64, provider, name, args string) []byte {
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.LittleEndian, location)
+		_ = binary.Write(&buf, binary.LittleEndian, base)
+		_ = binary.Write(&buf, binary.LittleEndian, semaphore)
+		buf.WriteString(provider)
+		buf.WriteByte(0)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.WriteString(args)
+		buf.WriteByte(0)
+		return buf.Bytes()
+	}
+
+	t.Run("no stapsdt.base section, location used verbatim", func(t *testing.T) {
+		desc := buildDesc(0x1000, 0x500, 0x2000, "myprovider", "myprobe", "4@%eax")
+		note, err := decodeStapsdtDesc(desc, binary.LittleEndian, 8, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if note.Location != 0x1000 {
+			t.Errorf("Location = %#x, want %#x", note.Location, 0x1000)
+		}
+		if note.Provider != "myprovider" || note.Name != "myprobe" {
+			t.Errorf("Provider/Name = %q/%q, want %q/%q", note.Provider, note.Name, "myprovider", "myprobe")
+		}
+		if note.SemaphoreAddr != 0x2000 {
+			t.Errorf("SemaphoreAddr = %#x, want %#x", note.SemaphoreAddr, 0x2000)
+		}
+	})
+
+	t.Run("stapsdt.base section corrects for rebasing", func(t *testing.T) {
+		desc := buildDesc(0x1000, 0x500, 0, "p", "n", "")
+		note, err := decodeStapsdtDesc(desc, binary.LittleEndian, 8, 0x600)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// location - base + stapsdtBaseAddr = 0x1000 - 0x500 + 0x600
+		if want := uint64(0x1100); note.Location != want {
+			t.Errorf("Location = %#x, want %#x", note.Location, want)
+		}
+	})
+
+	t.Run("truncated descriptor", func(t *testing.T) {
+		if _, err := decodeStapsdtDesc([]byte{1, 2, 3}, binary.LittleEndian, 8, 0); err == nil {
+			t.Fatal("expected an error for a truncated descriptor")
+		}
+	})
+
+	t.Run("malformed descriptor strings", func(t *testing.T) {
+		desc := make([]byte, 8*3)
+		if _, err := decodeStapsdtDesc(desc, binary.LittleEndian, 8, 0); err == nil {
+			t.Fatal("expected an error for missing provider/name strings")
+		}
+	})
+}